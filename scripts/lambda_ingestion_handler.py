@@ -20,26 +20,173 @@ import hmac
 import base64
 import datetime
 import logging
+import math
+import re
 from typing import Any, Optional
 
 import urllib.request
 import urllib.error
 
+# Version of the normalized record layout, written to every record as
+# PipelineSchemaVersion so queries can branch during schema migrations.
+# Bump whenever parse_guardduty_finding's column set changes, record the new
+# set under the new version in tests/normalized_schema.golden.json, and pin its
+# digest in the test's RELEASED_SCHEMA_DIGESTS. Released entries are immutable.
+PIPELINE_SCHEMA_VERSION = "1"
+
 # ─── Configuration via Environment Variables ────────────────────────────────────
 
 LOG_TYPE = os.environ.get("LOG_TYPE", "AWSGuardDuty")
 AWS_REGION = os.environ.get("AWS_REGION", "eu-west-2")
 
+# Label stamped on every record as SourceEnvironment (e.g. "prod"), so a shared
+# workspace can tell which deployment a finding came from.
+SOURCE_ENVIRONMENT = os.environ.get("SOURCE_ENVIRONMENT", "")
+
 # Maximum number of attempts when posting to the Sentinel API.
 # Set to 1 to disable retries (useful in unit tests or strict SLA environments).
 _MAX_RETRIES: int = int(os.environ.get("MAX_RETRIES", "3"))
 
+# Resource tag keys to surface as dedicated "<Key>_tag" columns, comma-separated.
+# Example: TAG_COLUMNS="Environment,Owner" adds Environment_tag and Owner_tag.
+TAG_COLUMNS: list[str] = [
+    key.strip() for key in os.environ.get("TAG_COLUMNS", "").split(",") if key.strip()
+]
+
+# Finding fields to redact before ingestion, as comma-separated JSONPath-style
+# paths into the GuardDuty finding (e.g. "$.resource.accessKeyDetails.userName").
+# A "[*]" suffix on a segment walks every element of a list; on the last
+# segment it redacts each element. No other JSONPath syntax is supported, and
+# fields the parser computes on (severity, timestamps, the containers it walks)
+# can't be redacted; validate_config() rejects both at load.
+# REDACT_MODE is one of:
+#   hmac-sha256  keyed digest using REDACT_HMAC_KEY; deterministic, so still joinable
+#   sha256       unkeyed digest; low-entropy values (IPs, usernames) can be brute-forced
+#   drop         replace with null
+REDACT_FIELDS: list[str] = [
+    path.strip() for path in os.environ.get("REDACT_FIELDS", "").split(",") if path.strip()
+]
+REDACT_MODE = os.environ.get("REDACT_MODE", "sha256").lower()
+REDACT_HMAC_KEY = os.environ.get("REDACT_HMAC_KEY", "")
+REDACT_MODES = ("hmac-sha256", "sha256", "drop")
+REDACT_PATH_PATTERN = re.compile(r"\$(\.[A-Za-z0-9_]+(\[\*\])?)+")
+REDACT_PROTECTED_PATHS = (
+    "severity",
+    "createdAt",
+    "updatedAt",
+    "service.archived",
+    "service.eventFirstSeen",
+    "service.eventLastSeen",
+    "service.action.networkConnectionAction.remoteIpDetails.country",
+    "service.action.networkConnectionAction.remotePortDetails",
+    "service.action.networkConnectionAction.localPortDetails",
+    "service.action.awsApiCallAction.remoteIpDetails.country",
+    "resource.accessKeyDetails",
+    "resource.instanceDetails.networkInterfaces",
+    "resource.instanceDetails.tags",
+    "resource.eksClusterDetails.tags",
+    "resource.ecsClusterDetails.tags",
+    "resource.lambdaDetails.tags",
+    "resource.rdsDbInstanceDetails.tags",
+    "resource.s3BucketDetails.tags",
+)
+
+# Findings whose event time is older than this many hours are skipped rather
+# than ingested (e.g. replays after a long outage). 0 disables the check.
+# Parsed and checked by validate_config().
+MAX_FINDING_AGE_HOURS: float = 0.0
+
+# Archived findings (suppressed or resolved in GuardDuty) are skipped unless
+# INGEST_ARCHIVED is "true".
+INGEST_ARCHIVED = os.environ.get("INGEST_ARCHIVED", "false").lower() == "true"
+
+# Optional JSON file mapping AWS account ID → friendly name for the AccountName
+# column. Re-read whenever its mtime changes, so warm containers pick up edits.
+# The deployment package (/var/task) is read-only, so live edits only work
+# when the file sits on a mounted EFS path; a packaged file changes on redeploy.
+ACCOUNT_NAME_MAP_FILE = os.environ.get("ACCOUNT_NAME_MAP_FILE", "")
+
+# Response SLA per SeverityLevel, in hours from the finding's createdAt, used to
+# compute the SLADeadline column. Override with a JSON object of numbers, e.g.
+# SLA_HOURS='{"High": 2, "Medium": 12}'.
+# Severity levels missing from the table get no deadline.
+# Parsed and checked by validate_config().
+DEFAULT_SLA_HOURS = '{"Critical": 1, "High": 1, "Medium": 8, "Low": 24}'
+SLA_HOURS: dict[str, float] = {}
+
+# CloudWatch namespace for metrics emitted in Embedded Metric Format.
+METRICS_NAMESPACE = os.environ.get("METRICS_NAMESPACE", "GuardDutySentinel")
+
 # ─── Logging Setup ──────────────────────────────────────────────────────────────
 
 logger = logging.getLogger(__name__)
 logger.setLevel(os.environ.get("LOG_LEVEL", "INFO"))
 
 
+# ─── Metrics ────────────────────────────────────────────────────────────────────
+
+def emit_skip_metric(reason: str) -> None:
+    """
+    Count a skipped finding as SkippedFindings{Reason=reason}.
+
+    Written to stdout in CloudWatch Embedded Metric Format, which Lambda
+    forwards to CloudWatch Logs where it is extracted as a metric.
+    """
+    print(json.dumps({
+        "_aws": {
+            "Timestamp": int(datetime.datetime.now(datetime.timezone.utc).timestamp() * 1000),
+            "CloudWatchMetrics": [{
+                "Namespace": METRICS_NAMESPACE,
+                "Dimensions": [["Reason"]],
+                "Metrics": [{"Name": "SkippedFindings", "Unit": "Count"}],
+            }],
+        },
+        "Reason": reason,
+        "SkippedFindings": 1,
+    }))
+
+
+# ─── Account Name Resolution ────────────────────────────────────────────────────
+
+_account_names: dict[str, str] = {}
+_account_names_mtime: Optional[int] = None
+_account_names_error: Optional[str] = None
+
+
+def load_account_names(path: str) -> dict[str, str]:
+    """
+    Return the account ID → name map from path, reloading it if it changed.
+
+    A missing or invalid file is logged once per distinct error and the last
+    good map is kept, so a bad edit never fails ingestion or floods the logs.
+    """
+    global _account_names, _account_names_mtime, _account_names_error
+    if not path:
+        return {}
+    try:
+        mtime = os.stat(path).st_mtime_ns
+        if mtime != _account_names_mtime:
+            with open(path, encoding="utf-8") as f:
+                loaded = json.load(f)
+            if not isinstance(loaded, dict):
+                raise ValueError("expected a JSON object of account ID → name")
+            _account_names = {str(k): str(v) for k, v in loaded.items()}
+            _account_names_mtime = mtime
+            _account_names_error = None
+            logger.info(f"Loaded {len(_account_names)} account names from {path}")
+    except (OSError, ValueError) as e:
+        if str(e) != _account_names_error:
+            _account_names_error = str(e)
+            logger.warning(f"Could not load account name map {path}: {e}")
+    return _account_names
+
+
+def resolve_account_name(account_id: Optional[str]) -> Optional[str]:
+    """Return the friendly name for account_id, or the raw ID if unmapped."""
+    names = load_account_names(ACCOUNT_NAME_MAP_FILE)
+    return names.get(account_id, account_id) if account_id else account_id
+
+
 # ─── Sentinel API Authentication ────────────────────────────────────────────────
 
 def get_required_env(name: str) -> str:
@@ -76,10 +223,16 @@ def post_to_sentinel(
     log_type: str,
     workspace_id: Optional[str] = None,
     shared_key: Optional[str] = None,
+    content_hmac_key: Optional[str] = None,
 ) -> int:
     """
     Post JSON payload to the Log Analytics Data Collector API.
 
+    Every request carries an x-content-sha256 header: the hex SHA-256 of the
+    exact UTF-8 body bytes sent (the body is not compressed). When
+    content_hmac_key (or CONTENT_HMAC_KEY) is set, x-content-hmac-sha256 also
+    carries a hex HMAC-SHA256 of the same bytes for tamper-evidence.
+
     Returns:
         HTTP status code (200 = accepted, 4xx/5xx = error)
 
@@ -88,9 +241,11 @@ def post_to_sentinel(
     """
     workspace_id = workspace_id or get_required_env("SENTINEL_WORKSPACE_ID")
     shared_key = shared_key or get_required_env("SENTINEL_SHARED_KEY")
+    content_hmac_key = content_hmac_key or os.environ.get("CONTENT_HMAC_KEY")
 
     rfc1123_date = datetime.datetime.utcnow().strftime("%a, %d %b %Y %H:%M:%S GMT")
-    content_length = len(body)
+    body_bytes = body.encode("utf-8")
+    content_length = len(body_bytes)
 
     signature = build_signature(
         workspace_id, shared_key, rfc1123_date, content_length
@@ -107,15 +262,121 @@ def post_to_sentinel(
         "Log-Type": log_type,
         "x-ms-date": rfc1123_date,
         "time-generated-field": "TimeGenerated",
+        "x-content-sha256": hashlib.sha256(body_bytes).hexdigest(),
     }
+    if content_hmac_key:
+        headers["x-content-hmac-sha256"] = hmac.new(
+            content_hmac_key.encode("utf-8"), body_bytes, hashlib.sha256
+        ).hexdigest()
 
-    req = urllib.request.Request(uri, data=body.encode("utf-8"), headers=headers)
+    req = urllib.request.Request(uri, data=body_bytes, headers=headers)
     with urllib.request.urlopen(req) as response:
         return response.getcode()
 
 
 # ─── GuardDuty Event Parsing & Transformation ───────────────────────────────────
 
+def extract_resource_tags(resource: dict[str, Any]) -> dict[str, str]:
+    """
+    Collect the affected resource's tags as a flat key → value dict.
+
+    GuardDuty reports tags as [{"key": ..., "value": ...}] lists under the
+    resource-type-specific details (instance, EKS, ECS, Lambda, RDS, S3).
+    """
+    tag_lists = [
+        (resource.get(details) or {}).get("tags")
+        for details in (
+            "instanceDetails",
+            "eksClusterDetails",
+            "ecsClusterDetails",
+            "lambdaDetails",
+            "rdsDbInstanceDetails",
+        )
+    ]
+    tag_lists.extend(
+        bucket.get("tags") for bucket in resource.get("s3BucketDetails") or []
+    )
+
+    tags: dict[str, str] = {}
+    for tag_list in tag_lists:
+        for tag in tag_list or []:
+            if tag.get("key") and tag["key"] not in tags:
+                tags[tag["key"]] = tag.get("value") or ""
+    return tags
+
+
+def _redacted_value(value: Any, mode: str, hmac_key: str) -> Any:
+    if value is None or mode == "drop":
+        return None
+    text = value if isinstance(value, str) else json.dumps(value, sort_keys=True)
+    if mode == "hmac-sha256":
+        return hmac.new(
+            hmac_key.encode("utf-8"), text.encode("utf-8"), hashlib.sha256
+        ).hexdigest()
+    return hashlib.sha256(text.encode("utf-8")).hexdigest()
+
+
+def _redact_path(node: Any, parts: list[str], mode: str, hmac_key: str) -> None:
+    if not parts or not isinstance(node, dict):
+        return
+    key, rest = parts[0], parts[1:]
+    if key.endswith("[*]"):
+        items = node.get(key[:-3])
+        if not isinstance(items, list):
+            return
+        if rest:
+            for item in items:
+                _redact_path(item, rest, mode, hmac_key)
+        else:
+            node[key[:-3]] = [_redacted_value(item, mode, hmac_key) for item in items]
+    elif key in node:
+        if rest:
+            _redact_path(node[key], rest, mode, hmac_key)
+        else:
+            node[key] = _redacted_value(node[key], mode, hmac_key)
+
+
+def redact_finding(
+    finding: dict[str, Any], paths: list[str], mode: str, hmac_key: str = ""
+) -> dict[str, Any]:
+    """
+    Return a copy of the finding with each configured path redacted.
+
+    Redaction runs on the raw finding before flattening, so both the derived
+    column and RawFinding carry the redacted value. Paths that don't resolve
+    are ignored.
+    """
+    redacted = json.loads(json.dumps(finding))
+    for path in paths:
+        parts = [p for p in path.removeprefix("$").split(".") if p]
+        _redact_path(redacted, parts, mode, hmac_key)
+    return redacted
+
+
+def finding_event_time(finding: dict[str, Any]) -> str:
+    """
+    Pick the TimeGenerated value for a finding.
+
+    Precedence: updatedAt, then service.eventLastSeen, then createdAt, and only
+    if the finding carries none of these, the ingestion time. Using the
+    finding's own time keeps Sentinel timelines correct during backfills.
+    """
+    service = finding.get("service") or {}
+    for value in (
+        finding.get("updatedAt"),
+        service.get("eventLastSeen"),
+        finding.get("createdAt"),
+    ):
+        if value:
+            return value
+    return datetime.datetime.now(datetime.timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+def tag_column_name(key: str) -> str:
+    """Map a tag key to a column name accepted by the Data Collector API."""
+    return re.sub(r"[^A-Za-z0-9_]", "_", key) + "_tag"
+
+
 def parse_guardduty_finding(event: dict[str, Any]) -> dict[str, Any]:
     """
     Parse a GuardDuty finding from EventBridge format into a flat,
@@ -133,6 +394,9 @@ def parse_guardduty_finding(event: dict[str, Any]) -> dict[str, Any]:
     else:
         raise ValueError(f"Unrecognized event format: {list(event.keys())[:5]}")
 
+    if REDACT_FIELDS:
+        finding = redact_finding(finding, REDACT_FIELDS, REDACT_MODE, REDACT_HMAC_KEY)
+
     # ── Core fields ──────────────────────────────────────────────────────────
     severity_raw = finding.get("severity", 0)
     severity_level = (
@@ -165,8 +429,8 @@ def parse_guardduty_finding(event: dict[str, Any]) -> dict[str, Any]:
     access_key = resource.get("accessKeyDetails", {})
 
     # ── Build normalized record ──────────────────────────────────────────────
-    return {
-        "TimeGenerated": finding.get("updatedAt", finding.get("createdAt")),
+    record = {
+        "TimeGenerated": finding_event_time(finding),
         "FindingId": finding.get("id"),
         "FindingType": finding.get("type"),
         "Severity": severity_raw,
@@ -174,8 +438,10 @@ def parse_guardduty_finding(event: dict[str, Any]) -> dict[str, Any]:
         "Title": finding.get("title"),
         "Description": finding.get("description"),
         "AwsAccountId": finding.get("accountId"),
+        "AccountName": resolve_account_name(finding.get("accountId")),
         "AwsRegion": finding.get("region", AWS_REGION),
         "SchemaVersion": finding.get("schemaVersion"),
+        "PipelineSchemaVersion": PIPELINE_SCHEMA_VERSION,
         "ResourceType": resource_type,
         "ActionType": action_type,
         # Network context
@@ -197,12 +463,148 @@ def parse_guardduty_finding(event: dict[str, Any]) -> dict[str, Any]:
         "VpcId": (instance.get("networkInterfaces") or [{}])[0].get("vpcId"),
         # Service metadata
         "DetectorId": finding.get("service", {}).get("detectorId"),
+        "SourceEnvironment": SOURCE_ENVIRONMENT,
         "EventFirstSeen": finding.get("service", {}).get("eventFirstSeen"),
         "EventLastSeen": finding.get("service", {}).get("eventLastSeen"),
+        "Archived": bool(finding.get("service", {}).get("archived", False)),
         # Raw JSON for full traceability
         "RawFinding": json.dumps(finding),
     }
 
+    # The SLA clock starts when the finding was first created, not at its
+    # latest update, so repeated updates don't push the deadline out.
+    record["SLADeadline"] = compute_sla_deadline(
+        severity_level,
+        finding.get("createdAt") or finding.get("service", {}).get("eventFirstSeen"),
+        SLA_HOURS,
+    )
+
+    # Configured resource tags, empty when the finding doesn't carry the tag
+    if TAG_COLUMNS:
+        tags = extract_resource_tags(resource)
+        for key in TAG_COLUMNS:
+            record[tag_column_name(key)] = tags.get(key, "")
+
+    return record
+
+
+def parse_timestamp(value: Optional[str]) -> Optional[datetime.datetime]:
+    """Parse a GuardDuty ISO-8601 timestamp, returning None if absent or invalid."""
+    if not value:
+        return None
+    try:
+        parsed = datetime.datetime.fromisoformat(value.replace("Z", "+00:00"))
+    except ValueError:
+        return None
+    if parsed.tzinfo is None:
+        parsed = parsed.replace(tzinfo=datetime.timezone.utc)
+    return parsed
+
+
+def is_stale_finding(
+    record: dict[str, Any],
+    max_age_hours: float,
+    now: Optional[datetime.datetime] = None,
+) -> bool:
+    """
+    Return True if the finding's event time is older than max_age_hours.
+
+    Uses the record's TimeGenerated (the finding's own timestamp), never the
+    delivery time. Findings without a parseable timestamp are not considered
+    stale so they are still ingested.
+    """
+    event_time = parse_timestamp(record.get("TimeGenerated"))
+    if not max_age_hours or event_time is None:
+        return False
+    now = now or datetime.datetime.now(datetime.timezone.utc)
+    return now - event_time > datetime.timedelta(hours=max_age_hours)
+
+
+def compute_sla_deadline(
+    severity_level: str, event_time: Optional[str], sla_hours: dict[str, float]
+) -> Optional[str]:
+    """Return event_time plus the SLA for severity_level, or None if either is unknown."""
+    start = parse_timestamp(event_time)
+    hours = sla_hours.get(severity_level)
+    if start is None or hours is None:
+        return None
+    deadline = start + datetime.timedelta(hours=float(hours))
+    return deadline.astimezone(datetime.timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")
+
+
+# ─── Configuration Validation ───────────────────────────────────────────────────
+
+def validate_config() -> None:
+    """
+    Parse and check settings at import, so a bad deployment fails once with a
+    clear error instead of misreporting every finding.
+    """
+    global MAX_FINDING_AGE_HOURS, SLA_HOURS
+
+    tag_columns: dict[str, str] = {}
+    for key in TAG_COLUMNS:
+        column = tag_column_name(key)
+        if tag_columns.get(column, key) != key:
+            raise RuntimeError(
+                f"TAG_COLUMNS keys {tag_columns[column]!r} and {key!r} "
+                f"both map to column {column}"
+            )
+        tag_columns[column] = key
+
+    if REDACT_MODE not in REDACT_MODES:
+        raise RuntimeError(
+            f"Unsupported REDACT_MODE {REDACT_MODE!r}; expected one of {', '.join(REDACT_MODES)}"
+        )
+    if REDACT_MODE == "hmac-sha256" and not REDACT_HMAC_KEY:
+        raise RuntimeError("REDACT_MODE=hmac-sha256 requires REDACT_HMAC_KEY")
+
+    for path in REDACT_FIELDS:
+        if not REDACT_PATH_PATTERN.fullmatch(path):
+            raise RuntimeError(
+                f"Unsupported REDACT_FIELDS path {path!r}; expected $.key.key with "
+                f"an optional [*] after a key"
+            )
+        parts = path[2:].replace("[*]", "").split(".")
+        for protected in REDACT_PROTECTED_PATHS:
+            # Redacting a protected field, or a container holding one, would
+            # break parsing of every finding.
+            if protected.split(".")[:len(parts)] == parts:
+                raise RuntimeError(
+                    f"REDACT_FIELDS path {path!r} covers $.{protected}, "
+                    f"which the parser needs and can't be redacted"
+                )
+
+    raw_max_age = os.environ.get("MAX_FINDING_AGE_HOURS", "0")
+    try:
+        max_age = float(raw_max_age)
+    except ValueError:
+        max_age = math.nan
+    if not (math.isfinite(max_age) and max_age >= 0):
+        raise RuntimeError(
+            f"MAX_FINDING_AGE_HOURS must be a finite number >= 0 (0 disables), "
+            f"got {raw_max_age!r}"
+        )
+    MAX_FINDING_AGE_HOURS = max_age
+
+    raw_sla_hours = os.environ.get("SLA_HOURS") or DEFAULT_SLA_HOURS
+    try:
+        sla_hours = json.loads(raw_sla_hours)
+    except ValueError:
+        sla_hours = None
+    if not isinstance(sla_hours, dict) or not all(
+        isinstance(hours, (int, float)) and not isinstance(hours, bool)
+        and math.isfinite(hours) and hours >= 0
+        for hours in sla_hours.values()
+    ):
+        raise RuntimeError(
+            f"SLA_HOURS must be a JSON object of SeverityLevel → finite, non-negative "
+            f"hours, got {raw_sla_hours!r}"
+        )
+    SLA_HOURS = sla_hours
+
+
+validate_config()
+
 
 # ─── Lambda Handler ──────────────────────────────────────────────────────────────
 
@@ -232,6 +634,33 @@ def handler(event: dict[str, Any], context: Any) -> dict[str, Any]:
             f"Account: {normalized.get('AwsAccountId')}"
         )
 
+        # ── Drop stale and archived findings ─────────────────────────────────
+        # skip_reason is a stable code for metrics and queries; skip_detail is
+        # the human-readable explanation.
+        skip_reason = skip_detail = None
+        if is_stale_finding(normalized, MAX_FINDING_AGE_HOURS):
+            skip_reason = "stale"
+            skip_detail = f"Older than {MAX_FINDING_AGE_HOURS:g}h"
+        elif normalized.get("Archived") and not INGEST_ARCHIVED:
+            skip_reason = "archived"
+            skip_detail = "Archived in GuardDuty"
+
+        if skip_reason:
+            logger.info(
+                f"Skipping finding: {finding_type} | Reason: {skip_detail}",
+                extra={"finding_id": normalized.get("FindingId"), "skip_reason": skip_reason},
+            )
+            emit_skip_metric(skip_reason)
+            return {
+                "statusCode": 200,
+                "body": json.dumps({
+                    "message": f"Finding skipped: {skip_detail}",
+                    "reason": skip_reason,
+                    "findingId": normalized.get("FindingId"),
+                    "eventTime": normalized.get("TimeGenerated"),
+                }),
+            }
+
         # ── Post to Sentinel ─────────────────────────────────────────────────
         payload = json.dumps([normalized])
         status_code = post_to_sentinel(payload, LOG_TYPE)
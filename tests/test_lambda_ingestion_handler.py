@@ -1,7 +1,14 @@
 import base64
+import contextlib
+import datetime
+import hashlib
+import hmac
 import importlib.util
+import io
 import json
+import os
 import pathlib
+import tempfile
 import unittest
 from unittest import mock
 
@@ -12,6 +19,13 @@ MODULE_PATH = (
     / "lambda_ingestion_handler.py"
 )
 
+SCHEMA_GOLDEN_PATH = pathlib.Path(__file__).resolve().parent / "normalized_schema.golden.json"
+# SHA-256 of each released version's column list in the golden file, so a
+# released entry can't be rewritten in place. Add a line when bumping the version.
+RELEASED_SCHEMA_DIGESTS = {
+    "1": "ed741c3d1c8388c0d90fe23c1f329aed850ebcb22517bd60e6cf90a203b9db2c",
+}
+
 
 def load_handler_module():
     spec = importlib.util.spec_from_file_location("lambda_ingestion_handler", MODULE_PATH)
@@ -86,6 +100,241 @@ class LambdaIngestionHandlerTests(unittest.TestCase):
         with self.assertRaises(ValueError):
             self.handler.parse_guardduty_finding({"source": "aws.guardduty"})
 
+    def test_parse_populates_configured_tag_columns(self):
+        finding = self.sample_finding()
+        finding["resource"] = {
+            "resourceType": "Instance",
+            "instanceDetails": {
+                "instanceId": "i-0abc",
+                "tags": [
+                    {"key": "Environment", "value": "prod"},
+                    {"key": "Name", "value": "bastion"},
+                ],
+            },
+        }
+
+        with mock.patch.dict("os.environ", {"TAG_COLUMNS": "Environment, Owner"}):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(finding)
+
+        self.assertEqual(parsed["Environment_tag"], "prod")
+        self.assertEqual(parsed["Owner_tag"], "")
+        self.assertNotIn("Name_tag", parsed)
+
+    def test_parse_reads_tags_from_lambda_ecs_and_rds_details(self):
+        with mock.patch.dict("os.environ", {"TAG_COLUMNS": "Environment"}):
+            m = load_handler_module()
+
+        for details in ("lambdaDetails", "ecsClusterDetails", "rdsDbInstanceDetails"):
+            finding = self.sample_finding()
+            finding["resource"] = {
+                details: {"tags": [{"key": "Environment", "value": "prod"}]},
+            }
+            parsed = m.parse_guardduty_finding(finding)
+            self.assertEqual(parsed["Environment_tag"], "prod", details)
+
+    def test_colliding_tag_columns_rejected_at_load(self):
+        with mock.patch.dict("os.environ", {"TAG_COLUMNS": "Env-Name,Env_Name"}):
+            with self.assertRaisesRegex(RuntimeError, "Env_Name_tag"):
+                load_handler_module()
+
+    def test_parse_adds_no_tag_columns_by_default(self):
+        with mock.patch.dict("os.environ", {}, clear=True):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        self.assertFalse([k for k in parsed if k.endswith("_tag")])
+
+    def test_parse_hashes_redacted_fields_deterministically(self):
+        env = {"REDACT_FIELDS": "$.resource.accessKeyDetails.userName"}
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+        first = m.parse_guardduty_finding(self.sample_finding())
+        second = m.parse_guardduty_finding(self.sample_finding())
+
+        expected = hashlib.sha256(b"analyst").hexdigest()
+        self.assertEqual(first["UserName"], expected)
+        self.assertEqual(second["UserName"], expected)
+        raw = json.loads(first["RawFinding"])
+        self.assertEqual(raw["resource"]["accessKeyDetails"]["userName"], expected)
+        # Unconfigured fields pass through unchanged
+        self.assertEqual(first["AccessKeyId"], "AKIAEXAMPLE")
+        self.assertEqual(first["RemoteIp"], "203.0.113.10")
+
+    def test_parse_drops_redacted_fields_in_drop_mode(self):
+        env = {
+            "REDACT_FIELDS": "$.service.action.awsApiCallAction.remoteIpDetails.ipAddressV4",
+            "REDACT_MODE": "drop",
+        }
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        self.assertIsNone(parsed["RemoteIp"])
+        self.assertEqual(parsed["RemoteCountry"], "United Kingdom")
+
+    def test_parse_redacts_each_element_of_scalar_list(self):
+        env = {
+            "REDACT_FIELDS": "$.resource.instanceDetails.networkInterfaces[*].ipv6Addresses[*]",
+            "REDACT_MODE": "hmac-sha256",
+            "REDACT_HMAC_KEY": "test-key",
+        }
+        finding = self.sample_finding()
+        finding["resource"]["instanceDetails"] = {
+            "networkInterfaces": [{"ipv6Addresses": ["2001:db8::1", "2001:db8::2"]}],
+        }
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(finding)
+
+        raw = json.loads(parsed["RawFinding"])
+        addresses = raw["resource"]["instanceDetails"]["networkInterfaces"][0]["ipv6Addresses"]
+        self.assertEqual(addresses, [
+            hmac.new(b"test-key", b"2001:db8::1", hashlib.sha256).hexdigest(),
+            hmac.new(b"test-key", b"2001:db8::2", hashlib.sha256).hexdigest(),
+        ])
+
+    def test_unsupported_redact_paths_rejected_at_load(self):
+        for path in (
+            "$..userName",
+            "$.resource.instanceDetails.networkInterfaces[0].privateIpAddress",
+            "$.resource['accessKeyDetails'].userName",
+            "resource.accessKeyDetails.userName",
+        ):
+            with self.subTest(path=path):
+                with mock.patch.dict("os.environ", {"REDACT_FIELDS": path}):
+                    with self.assertRaisesRegex(RuntimeError, "Unsupported REDACT_FIELDS"):
+                        load_handler_module()
+
+    def test_redacting_parsed_fields_rejected_at_load(self):
+        for path in ("$.severity", "$.updatedAt", "$.service", "$.resource.accessKeyDetails"):
+            with self.subTest(path=path):
+                with mock.patch.dict("os.environ", {"REDACT_FIELDS": path}):
+                    with self.assertRaisesRegex(RuntimeError, "can't be redacted"):
+                        load_handler_module()
+
+    def test_unknown_redact_mode_rejected_at_load(self):
+        with mock.patch.dict("os.environ", {"REDACT_MODE": "hash"}):
+            with self.assertRaisesRegex(RuntimeError, "REDACT_MODE"):
+                load_handler_module()
+        with mock.patch.dict("os.environ", {"REDACT_MODE": "hmac-sha256"}):
+            with self.assertRaisesRegex(RuntimeError, "REDACT_HMAC_KEY"):
+                load_handler_module()
+
+    def test_parse_resolves_account_name_and_reloads_map(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            map_path = pathlib.Path(tmp) / "accounts.json"
+            map_path.write_text(json.dumps({"123456789012": "prod-security"}))
+
+            with mock.patch.dict("os.environ", {"ACCOUNT_NAME_MAP_FILE": str(map_path)}):
+                m = load_handler_module()
+
+            mapped = m.parse_guardduty_finding(self.sample_finding())
+            unmapped_finding = self.sample_finding()
+            unmapped_finding["accountId"] = "210987654321"
+            unmapped = m.parse_guardduty_finding(unmapped_finding)
+
+            self.assertEqual(mapped["AccountName"], "prod-security")
+            self.assertEqual(unmapped["AccountName"], "210987654321")
+
+            map_path.write_text(json.dumps({
+                "123456789012": "prod-security",
+                "210987654321": "staging",
+            }))
+            stat = map_path.stat()
+            os.utime(map_path, ns=(stat.st_atime_ns, stat.st_mtime_ns + 1_000_000_000))
+
+            reloaded = m.parse_guardduty_finding(unmapped_finding)
+
+        self.assertEqual(reloaded["AccountName"], "staging")
+
+    def test_account_name_map_warning_logged_once_per_error(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            map_path = pathlib.Path(tmp) / "accounts.json"
+            map_path.write_text("not json")
+
+            with mock.patch.dict("os.environ", {"ACCOUNT_NAME_MAP_FILE": str(map_path)}):
+                m = load_handler_module()
+
+            with self.assertLogs(m.logger, level="WARNING") as logs:
+                for _ in range(3):
+                    parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        self.assertEqual(parsed["AccountName"], "123456789012")
+        self.assertEqual(len(logs.records), 1)
+
+    def test_parse_account_name_defaults_to_account_id(self):
+        with mock.patch.dict("os.environ", {}, clear=True):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        self.assertEqual(parsed["AccountName"], "123456789012")
+
+    def test_parse_computes_sla_deadline_from_severity(self):
+        high = self.sample_finding()
+        high["severity"] = 7.5
+        medium = self.sample_finding()
+        medium["severity"] = 5.0
+
+        env = {"SLA_HOURS": '{"High": 1, "Medium": 8}'}
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+        high_parsed = m.parse_guardduty_finding(high)
+        medium_parsed = m.parse_guardduty_finding(medium)
+        critical_parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        # Deadlines count from createdAt (10:00), not updatedAt (10:05)
+        self.assertEqual(high_parsed["SLADeadline"], "2025-01-15T11:00:00Z")
+        self.assertEqual(medium_parsed["SLADeadline"], "2025-01-15T18:00:00Z")
+        # Critical isn't in the configured table, so no deadline is set
+        self.assertIsNone(critical_parsed["SLADeadline"])
+
+    def test_invalid_sla_hours_rejected_at_load(self):
+        for value in (
+            '{"Medium": "8h"}', '[1, 8]', '{"High": true}', 'High=1', '{"Critical": Infinity}',
+        ):
+            with self.subTest(value=value):
+                with mock.patch.dict("os.environ", {"SLA_HOURS": value}):
+                    with self.assertRaisesRegex(RuntimeError, "SLA_HOURS"):
+                        load_handler_module()
+
+    def test_parse_populates_detector_metadata_columns(self):
+        with mock.patch.dict("os.environ", {"SOURCE_ENVIRONMENT": "prod"}):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(self.sample_finding())
+
+        self.assertEqual(parsed["DetectorId"], "detector-123")
+        self.assertEqual(parsed["SourceEnvironment"], "prod")
+
+    def test_parse_time_generated_from_event_time(self):
+        finding = self.sample_finding()
+        finding["updatedAt"] = "2024-03-01T12:00:00Z"
+
+        parsed = self.handler.parse_guardduty_finding(finding)
+
+        self.assertEqual(parsed["TimeGenerated"], "2024-03-01T12:00:00Z")
+
+    def test_parse_time_generated_fallback_precedence(self):
+        finding = self.sample_finding()
+        del finding["updatedAt"]
+        self.assertEqual(
+            self.handler.parse_guardduty_finding(finding)["TimeGenerated"],
+            "2025-01-15T10:05:00Z",  # service.eventLastSeen
+        )
+
+        del finding["service"]["eventLastSeen"]
+        self.assertEqual(
+            self.handler.parse_guardduty_finding(finding)["TimeGenerated"],
+            "2025-01-15T10:00:00Z",  # createdAt
+        )
+
+        del finding["createdAt"]
+        before = datetime.datetime.now(datetime.timezone.utc).replace(microsecond=0)
+        ingested = self.handler.parse_timestamp(
+            self.handler.parse_guardduty_finding(finding)["TimeGenerated"]
+        )
+        self.assertGreaterEqual(ingested, before)
+
     def test_module_import_does_not_require_lambda_environment(self):
         with mock.patch.dict("os.environ", {}, clear=True):
             module = load_handler_module()
@@ -118,6 +367,39 @@ class LambdaIngestionHandlerTests(unittest.TestCase):
         self.assertEqual(request.headers["Log-type"], "AWSGuardDuty")
         self.assertIn("SharedKey workspace-123:", request.headers["Authorization"])
 
+    def test_post_to_sentinel_sets_content_hash_headers(self):
+        response = mock.Mock()
+        response.getcode.return_value = 200
+        response.__enter__ = mock.Mock(return_value=response)
+        response.__exit__ = mock.Mock(return_value=None)
+
+        shared_key = base64.b64encode(b"test-key").decode("utf-8")
+        body = '[{"FindingId":"finding-123","Title":"Zugriff verweigert – ü"}]'
+        with mock.patch.object(
+            self.handler.urllib.request, "urlopen", return_value=response
+        ) as urlopen:
+            self.handler.post_to_sentinel(
+                body, "AWSGuardDuty",
+                workspace_id="ws-id", shared_key=shared_key,
+            )
+            self.handler.post_to_sentinel(
+                body, "AWSGuardDuty",
+                workspace_id="ws-id", shared_key=shared_key,
+                content_hmac_key="integrity-key",
+            )
+
+        plain, signed = (call.args[0] for call in urlopen.call_args_list)
+        sent = plain.data
+        self.assertEqual(sent, body.encode("utf-8"))
+        self.assertEqual(
+            plain.headers["X-content-sha256"], hashlib.sha256(sent).hexdigest()
+        )
+        self.assertNotIn("X-content-hmac-sha256", plain.headers)
+        self.assertEqual(
+            signed.headers["X-content-hmac-sha256"],
+            hmac.new(b"integrity-key", signed.data, hashlib.sha256).hexdigest(),
+        )
+
     # ── post_to_sentinel: retry logic ────────────────────────────────────────
 
     def test_post_to_sentinel_retries_on_5xx(self):
@@ -248,6 +530,162 @@ class LambdaIngestionHandlerTests(unittest.TestCase):
         result = self.handler.handler({"findings": []}, None)
         self.assertEqual(result["statusCode"], 400)
 
+    # ── Finding age filtering ─────────────────────────────────────────────────
+
+    def test_is_stale_finding_uses_event_time(self):
+        now = datetime.datetime(2025, 1, 16, 10, 0, tzinfo=datetime.timezone.utc)
+
+        fresh = {"TimeGenerated": "2025-01-16T08:00:00Z"}
+        stale = {"TimeGenerated": "2025-01-14T10:00:00Z"}
+        untimed = {"TimeGenerated": None}
+
+        self.assertFalse(self.handler.is_stale_finding(fresh, 24, now=now))
+        self.assertTrue(self.handler.is_stale_finding(stale, 24, now=now))
+        self.assertFalse(self.handler.is_stale_finding(untimed, 24, now=now))
+        self.assertFalse(self.handler.is_stale_finding(stale, 0, now=now))
+
+    def test_handler_ingests_only_findings_within_max_age(self):
+        good_response = mock.Mock()
+        good_response.getcode.return_value = 200
+        good_response.__enter__ = mock.Mock(return_value=good_response)
+        good_response.__exit__ = mock.Mock(return_value=None)
+
+        now = datetime.datetime.now(datetime.timezone.utc)
+        fresh = self.sample_finding()
+        fresh["updatedAt"] = (now - datetime.timedelta(hours=1)).isoformat()
+        stale = self.sample_finding()
+        stale["id"] = "finding-old"
+        stale["updatedAt"] = (now - datetime.timedelta(days=3)).isoformat()
+
+        shared_key = base64.b64encode(b"test-key").decode("utf-8")
+        env = {
+            "SENTINEL_WORKSPACE_ID": "ws-id",
+            "SENTINEL_SHARED_KEY": shared_key,
+            "MAX_FINDING_AGE_HOURS": "24",
+        }
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+            with mock.patch.object(
+                m.urllib.request, "urlopen", return_value=good_response
+            ) as urlopen, contextlib.redirect_stdout(io.StringIO()) as stdout:
+                fresh_result = m.handler(fresh, None)
+                stale_result = m.handler(stale, None)
+
+        self.assertEqual(fresh_result["statusCode"], 200)
+        self.assertEqual(stale_result["statusCode"], 200)
+        stale_body = json.loads(stale_result["body"])
+        self.assertEqual(stale_body["reason"], "stale")
+        self.assertEqual(stale_body["message"], "Finding skipped: Older than 24h")
+        self.assertEqual(urlopen.call_count, 1)
+        metric = json.loads(stdout.getvalue())
+        self.assertEqual(metric["Reason"], "stale")
+        self.assertEqual(metric["SkippedFindings"], 1)
+        self.assertEqual(
+            metric["_aws"]["CloudWatchMetrics"][0]["Metrics"][0]["Name"], "SkippedFindings"
+        )
+        posted = json.loads(urlopen.call_args.args[0].data)
+        self.assertEqual(posted[0]["FindingId"], "finding-123")
+
+    def test_invalid_max_finding_age_rejected_at_load(self):
+        for value in ("-1", "nan", "inf", "abc"):
+            with self.subTest(value=value):
+                with mock.patch.dict("os.environ", {"MAX_FINDING_AGE_HOURS": value}):
+                    with self.assertRaisesRegex(RuntimeError, "MAX_FINDING_AGE_HOURS"):
+                        load_handler_module()
+
+    # ── Archived findings ─────────────────────────────────────────────────────
+
+    def _ingest_archived_and_active(self, ingest_archived):
+        good_response = mock.Mock()
+        good_response.getcode.return_value = 200
+        good_response.__enter__ = mock.Mock(return_value=good_response)
+        good_response.__exit__ = mock.Mock(return_value=None)
+
+        active = self.sample_finding()
+        archived = self.sample_finding()
+        archived["id"] = "finding-archived"
+        archived["service"]["archived"] = True
+
+        shared_key = base64.b64encode(b"test-key").decode("utf-8")
+        env = {
+            "SENTINEL_WORKSPACE_ID": "ws-id",
+            "SENTINEL_SHARED_KEY": shared_key,
+            "INGEST_ARCHIVED": ingest_archived,
+        }
+        with mock.patch.dict("os.environ", env):
+            m = load_handler_module()
+            with mock.patch.object(
+                m.urllib.request, "urlopen", return_value=good_response
+            ) as urlopen, contextlib.redirect_stdout(io.StringIO()) as stdout:
+                m.handler(active, None)
+                archived_result = m.handler(archived, None)
+
+        posted_ids = [
+            json.loads(call.args[0].data)[0]["FindingId"]
+            for call in urlopen.call_args_list
+        ]
+        return posted_ids, archived_result, stdout.getvalue()
+
+    def test_handler_skips_archived_findings_by_default(self):
+        posted_ids, archived_result, stdout = self._ingest_archived_and_active("false")
+
+        self.assertEqual(posted_ids, ["finding-123"])
+        body = json.loads(archived_result["body"])
+        self.assertEqual(body["message"], "Finding skipped: Archived in GuardDuty")
+        self.assertEqual(body["reason"], "archived")
+        metric = json.loads(stdout)
+        self.assertEqual(metric["Reason"], "archived")
+        self.assertEqual(metric["SkippedFindings"], 1)
+
+    def test_handler_ingests_archived_findings_when_enabled(self):
+        posted_ids, archived_result, stdout = self._ingest_archived_and_active("true")
+
+        self.assertEqual(posted_ids, ["finding-123", "finding-archived"])
+        self.assertEqual(archived_result["statusCode"], 200)
+        self.assertEqual(stdout, "")
+
+    # ── Schema versioning ─────────────────────────────────────────────────────
+
+    def test_schema_version_bumped(self):
+        """
+        The column set may only change together with PIPELINE_SCHEMA_VERSION.
+
+        The golden file keeps the column set of every released version, and
+        RELEASED_SCHEMA_DIGESTS pins each of those sets, so a changed schema
+        can't be recorded under the existing version number.
+        """
+        with mock.patch.dict("os.environ", {}, clear=True):
+            m = load_handler_module()
+        parsed = m.parse_guardduty_finding(self.sample_finding())
+        golden = json.loads(SCHEMA_GOLDEN_PATH.read_text())
+        version = m.PIPELINE_SCHEMA_VERSION
+        columns = sorted(parsed)
+
+        self.assertEqual(parsed["PipelineSchemaVersion"], version)
+        self.assertEqual(
+            sorted(golden), sorted(RELEASED_SCHEMA_DIGESTS),
+            f"Every version in {SCHEMA_GOLDEN_PATH.name} needs a RELEASED_SCHEMA_DIGESTS entry",
+        )
+        for released, digest in RELEASED_SCHEMA_DIGESTS.items():
+            self.assertEqual(
+                hashlib.sha256(json.dumps(golden[released]).encode("utf-8")).hexdigest(),
+                digest,
+                f"Columns for released version {released} changed in "
+                f"{SCHEMA_GOLDEN_PATH.name}; bump PIPELINE_SCHEMA_VERSION instead",
+            )
+        self.assertEqual(
+            version, max(golden, key=int),
+            f"Record the columns for PIPELINE_SCHEMA_VERSION {version} in {SCHEMA_GOLDEN_PATH.name}",
+        )
+        stored = golden[version]
+        self.assertEqual(
+            columns, stored,
+            f"Normalized columns differ from version {version} in {SCHEMA_GOLDEN_PATH.name} "
+            f"(added {sorted(set(columns) - set(stored))}, "
+            f"removed {sorted(set(stored) - set(columns))}); bump PIPELINE_SCHEMA_VERSION "
+            "and record the new column set under the new version",
+        )
+
 
 if __name__ == "__main__":
     unittest.main()